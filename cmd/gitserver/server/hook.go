@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/pkg/api"
+	"github.com/sourcegraph/sourcegraph/pkg/env"
+	"github.com/sourcegraph/sourcegraph/pkg/gitserver"
+	"github.com/sourcegraph/sourcegraph/pkg/repoupdater"
+)
+
+var postUpdateURL = env.Get("GITSERVER_POSTUPDATE_URL", "", "URL to POST to after a ref is updated via create-commit-from-patch (unset disables the hook)")
+
+var postUpdateHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// RefUpdatePayload is the JSON body POSTed to GITSERVER_POSTUPDATE_URL (and passed to
+// Server.PostRefUpdate) whenever handleCreateCommitFromPatch successfully moves a ref. It mirrors
+// Gogs' unified post-receive hook payload, trimmed to what downstream consumers here (search
+// indexing, the repo-updater scheduler, campaign status) actually need.
+type RefUpdatePayload struct {
+	Repo   string `json:"repo"`
+	Ref    string `json:"ref"`
+	OldOID string `json:"old_oid"`
+	NewOID string `json:"new_oid"`
+	Pusher string `json:"pusher"`
+}
+
+// dispatchPostRefUpdate runs after handleCreateCommitFromPatch successfully moves ref to newOID. It
+// synchronously notifies GITSERVER_POSTUPDATE_URL (if configured) and s.PostRefUpdate (if set), then
+// asks repo-updater to schedule a fresh update for repo, so downstream systems don't have to wait
+// for the next poll to learn about the new commit.
+func (s *Server) dispatchPostRefUpdate(ctx context.Context, repo, ref, oldOID, newOID, pusher string) {
+	payload := RefUpdatePayload{
+		Repo:   repo,
+		Ref:    ref,
+		OldOID: oldOID,
+		NewOID: newOID,
+		Pusher: pusher,
+	}
+
+	if postUpdateURL != "" {
+		if err := postRefUpdateHTTP(ctx, postUpdateURL, payload); err != nil {
+			log.Printf("gitserver: post-update hook POST failed for %s %s: %v", repo, ref, err)
+		}
+	}
+
+	if s.PostRefUpdate != nil {
+		s.PostRefUpdate(repo, ref, oldOID, newOID, pusher)
+	}
+
+	if _, err := repoupdater.DefaultClient.EnqueueRepoUpdate(ctx, gitserver.Repo{Name: api.RepoName(repo)}); err != nil {
+		log.Printf("gitserver: failed to enqueue repo update for %s after ref update: %v", repo, err)
+	}
+}
+
+func postRefUpdateHTTP(ctx context.Context, url string, payload RefUpdatePayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+
+	resp, err := postUpdateHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return &postUpdateHookError{statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+type postUpdateHookError struct {
+	statusCode int
+}
+
+func (e *postUpdateHookError) Error() string {
+	return http.StatusText(e.statusCode)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -19,6 +21,10 @@ import (
 
 var patchID uint64
 
+// zeroOID is git's conventional "nothing here" object ID, used as RefUpdatePayload.OldOID when
+// TargetRef didn't exist before handleCreateCommitFromPatch created it.
+const zeroOID = "0000000000000000000000000000000000000000"
+
 func (s *Server) handleCreateCommitFromPatch(w http.ResponseWriter, r *http.Request) {
 	var req protocol.CreatePatchFromPatchRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -82,49 +88,96 @@ func (s *Server) handleCreateCommitFromPatch(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	cmd = exec.CommandContext(ctx, "git", "apply", "--cached")
-	cmd.Dir = tmpRepoDir
-	cmd.Env = append(cmd.Env, tmpGitPathEnv, altObjectsEnv)
-	cmd.Stdin = strings.NewReader(req.Patch)
+	strategy := req.Strategy
+	if strategy == "" {
+		strategy = protocol.PatchStrategyStrict
+	}
 
-	if out, err := run(cmd); err != nil {
-		log15.Error("Failed to apply patch.", "ref", req.TargetRef, "output", string(out))
+	conflicts, err := applyPatch(ctx, run, tmpRepoDir, tmpGitPathEnv, altObjectsEnv, req.Patch, strategy)
+	if err != nil {
+		log15.Error("Failed to apply patch.", "ref", req.TargetRef, "strategy", strategy, "error", err)
 
 		http.Error(w, "gitserver: applying patch - "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	message := req.CommitInfo.Message
-	if message == "" {
-		message = "<Sourcegraph> Creating commit from patch"
-	}
-	authorName := req.CommitInfo.AuthorName
-	if authorName == "" {
-		authorName = "Sourcegraph"
-	}
-	authorEmail := req.CommitInfo.AuthorEmail
-	if authorEmail == "" {
-		authorEmail = "support@sourcegraph.com"
+	// `git am` already commits the patch to HEAD with its own message and author, so on a clean
+	// am_mailbox apply there's nothing left to commit. That's only true for the initial attempt,
+	// though: the fallback retry below always re-applies with PatchStrategyStrict, which (like a
+	// clean strict/three_way apply) only stages the patch and still needs the explicit commit.
+	amCommitted := conflicts == nil && strategy == protocol.PatchStrategyAMMailbox
+
+	if conflicts != nil {
+		if req.Fallback && strategy != protocol.PatchStrategyStrict {
+			log15.Warn("Non-strict patch apply left conflicts, falling back to strict apply.", "ref", req.TargetRef, "paths", conflicts.Paths)
+
+			// The three-way/am attempt left dir's index partially resolved (cleanly-applied hunks
+			// plus our conflict-resolution writes); reset back to the base revision so the strict
+			// retry starts from a clean slate instead of re-applying on top of that partial state.
+			cmd := exec.CommandContext(ctx, "git", "reset", "-q", string(req.BaseCommit))
+			cmd.Dir = tmpRepoDir
+			cmd.Env = append(cmd.Env, tmpGitPathEnv, altObjectsEnv)
+
+			if out, err := run(cmd); err != nil {
+				log15.Error("Failed to reset staging repo before fallback apply.", "ref", req.TargetRef, "base", req.BaseCommit, "output", string(out))
+
+				http.Error(w, "gitserver: resetting staging for fallback - "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if _, err := applyPatch(ctx, run, tmpRepoDir, tmpGitPathEnv, altObjectsEnv, req.Patch, protocol.PatchStrategyStrict); err != nil {
+				http.Error(w, "gitserver: applying patch (fallback) - "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			// The conflict tree (and any objects the apply wrote) live only in the tmp repo, which is
+			// removed on return; copy them into the real repo so conflicts.TreeOID stays readable.
+			cmd := exec.CommandContext(ctx, "cp", "-a", tmpObjectsDir+"/.", realObjectsDir)
+			cmd.Dir = tmpRepoDir
+
+			if _, err := run(cmd); err != nil {
+				http.Error(w, "gitserver: copying git objects - "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			sendPatchConflicts(w, conflicts)
+			return
+		}
 	}
 
-	cmd = exec.CommandContext(ctx, "git", "commit", "-m", message)
-	cmd.Dir = tmpRepoDir
-	cmd.Env = append(cmd.Env, []string{
-		tmpGitPathEnv,
-		altObjectsEnv,
-		"GIT_COMMITTER_NAME=sourcegraph-committer",
-		"GIT_COMMITTER_EMAIL=support@sourcegraph.com",
-		fmt.Sprintf("GIT_AUTHOR_NAME=%s", authorName),
-		fmt.Sprintf("GIT_AUTHOR_EMAIL=%s", authorEmail),
-		fmt.Sprintf("GIT_COMMITTER_DATE=%v", req.CommitInfo.Date),
-		fmt.Sprintf("GIT_AUTHOR_DATE=%v", req.CommitInfo.Date),
-	}...)
-
-	if out, err := run(cmd); err != nil {
-		log15.Error("Failed to commit patch.", "ref", req.TargetRef, "output", out)
+	if !amCommitted {
+		message := req.CommitInfo.Message
+		if message == "" {
+			message = "<Sourcegraph> Creating commit from patch"
+		}
+		authorName := req.CommitInfo.AuthorName
+		if authorName == "" {
+			authorName = "Sourcegraph"
+		}
+		authorEmail := req.CommitInfo.AuthorEmail
+		if authorEmail == "" {
+			authorEmail = "support@sourcegraph.com"
+		}
 
-		http.Error(w, "gitserver: commiting patch - "+err.Error(), http.StatusInternalServerError)
-		return
+		cmd := exec.CommandContext(ctx, "git", "commit", "-m", message)
+		cmd.Dir = tmpRepoDir
+		cmd.Env = append(cmd.Env, []string{
+			tmpGitPathEnv,
+			altObjectsEnv,
+			"GIT_COMMITTER_NAME=sourcegraph-committer",
+			"GIT_COMMITTER_EMAIL=support@sourcegraph.com",
+			fmt.Sprintf("GIT_AUTHOR_NAME=%s", authorName),
+			fmt.Sprintf("GIT_AUTHOR_EMAIL=%s", authorEmail),
+			fmt.Sprintf("GIT_COMMITTER_DATE=%v", req.CommitInfo.Date),
+			fmt.Sprintf("GIT_AUTHOR_DATE=%v", req.CommitInfo.Date),
+		}...)
+
+		if out, err := run(cmd); err != nil {
+			log15.Error("Failed to commit patch.", "ref", req.TargetRef, "output", out)
+
+			http.Error(w, "gitserver: commiting patch - "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	cmd = exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
@@ -147,6 +200,14 @@ func (s *Server) handleCreateCommitFromPatch(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	cmd = exec.CommandContext(ctx, "git", "rev-parse", "--verify", req.TargetRef)
+	cmd.Dir = realDir
+
+	oldOID := zeroOID
+	if out, err := cmd.Output(); err == nil {
+		oldOID = strings.TrimSpace(string(out))
+	}
+
 	cmd = exec.CommandContext(ctx, "git", "update-ref", req.TargetRef, cmtHash)
 	cmd.Dir = realDir
 
@@ -157,6 +218,8 @@ func (s *Server) handleCreateCommitFromPatch(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	s.dispatchPostRefUpdate(ctx, repo, req.TargetRef, oldOID, cmtHash, req.CommitInfo.AuthorName)
+
 	sendResp(w, "refs/"+ref)
 }
 
@@ -171,6 +234,258 @@ func sendResp(w http.ResponseWriter, commitID string) {
 	}
 }
 
+// applyPatch applies patch to the repo at dir using the given strategy. It returns a non-nil
+// PatchConflicts if the apply left unresolved conflicts, in which case the conflicted paths in dir's
+// index have been resolved to their "ours" side (see readConflicts). It returns a non-nil error only for failures unrelated to merge
+// conflicts, e.g. a strict apply failing outright or git erroring out.
+func applyPatch(ctx context.Context, run func(*exec.Cmd) ([]byte, error), dir, gitDirEnv, altObjectsEnv, patch string, strategy protocol.PatchStrategy) (*protocol.PatchConflicts, error) {
+	switch strategy {
+	case protocol.PatchStrategyThreeWay:
+		cmd := exec.CommandContext(ctx, "git", "apply", "--3way", "--cached")
+		cmd.Dir = dir
+		cmd.Env = append(cmd.Env, gitDirEnv, altObjectsEnv)
+		cmd.Stdin = strings.NewReader(patch)
+
+		if _, err := run(cmd); err != nil {
+			conflicts, cErr := readConflicts(ctx, run, dir, gitDirEnv, altObjectsEnv)
+			if cErr != nil {
+				return nil, cErr
+			}
+			if conflicts == nil {
+				return nil, err
+			}
+			return conflicts, nil
+		}
+		return nil, nil
+
+	case protocol.PatchStrategyAMMailbox:
+		cmd := exec.CommandContext(ctx, "git", "am", "--3way", "--keep-cr")
+		cmd.Dir = dir
+		// `git am` commits as it goes (preserving the patch's own author from the mailbox headers),
+		// so - unlike the other strategies - it needs a committer identity; dir has no git config of
+		// its own, so supply the same committer identity handleCreateCommitFromPatch's explicit commit
+		// step uses.
+		cmd.Env = append(cmd.Env, gitDirEnv, altObjectsEnv, "GIT_COMMITTER_NAME=sourcegraph-committer", "GIT_COMMITTER_EMAIL=support@sourcegraph.com")
+		cmd.Stdin = strings.NewReader(patch)
+
+		if _, err := run(cmd); err != nil {
+			conflicts, cErr := readConflicts(ctx, run, dir, gitDirEnv, altObjectsEnv)
+			if cErr != nil {
+				return nil, cErr
+			}
+			if conflicts == nil {
+				// Not a merge conflict (e.g. a malformed mailbox) - leave no half-finished am session
+				// behind and surface the original error.
+				abort := exec.CommandContext(ctx, "git", "am", "--abort")
+				abort.Dir = dir
+				abort.Env = append(abort.Env, gitDirEnv, altObjectsEnv)
+				run(abort)
+				return nil, err
+			}
+			return conflicts, nil
+		}
+		return nil, nil
+
+	default: // protocol.PatchStrategyStrict
+		cmd := exec.CommandContext(ctx, "git", "apply", "--cached")
+		cmd.Dir = dir
+		cmd.Env = append(cmd.Env, gitDirEnv, altObjectsEnv)
+		cmd.Stdin = strings.NewReader(patch)
+
+		if _, err := run(cmd); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+// conflictStage holds the mode and object git recorded for one side of an unmerged path, as
+// reported by `git ls-files -u`. Stage 1 is the common ancestor, stage 2 is "ours" (the tree
+// handleCreateCommitFromPatch reset dir to before applying the patch), stage 3 is "theirs" (what
+// the patch wants).
+type conflictStage struct {
+	mode   string
+	object string
+}
+
+// readConflicts inspects the index at dir for paths left unmerged by a three-way apply or am. It
+// returns a nil PatchConflicts (and nil error) if there are none, which tells the caller the
+// preceding apply failure wasn't a merge conflict at all.
+//
+// A --3way (or am --3way) apply only ever writes its merge result into the index, never the
+// working tree, so a worktree-vs-index diff here would always be empty; hunks are instead rendered
+// directly from the unmerged index stages. Likewise, `git write-tree` (with or without
+// --missing-ok) refuses to build a tree over unmerged (stage 1/2/3) entries, so the conflicted
+// paths are first resolved to their "ours" blob before the tree is written - the returned TreeOID
+// is therefore the base tree with all cleanly-applied hunks present and the conflicted paths left
+// at their pre-patch content, for a caller to layer a chosen resolution on top of.
+func readConflicts(ctx context.Context, run func(*exec.Cmd) ([]byte, error), dir, gitDirEnv, altObjectsEnv string) (*protocol.PatchConflicts, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-files", "-u")
+	cmd.Dir = dir
+	cmd.Env = append(cmd.Env, gitDirEnv, altObjectsEnv)
+
+	out, err := run(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	stages, paths, err := parseUnmergedStages(string(out))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	hunks := make(map[string]string, len(paths))
+	for _, p := range paths {
+		hunk, err := conflictHunk(ctx, run, dir, gitDirEnv, altObjectsEnv, stages[p])
+		if err != nil {
+			return nil, err
+		}
+		hunks[p] = hunk
+	}
+
+	treeOID, err := writeResolvedConflictTree(ctx, run, dir, gitDirEnv, altObjectsEnv, stages, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocol.PatchConflicts{
+		Paths:   paths,
+		Hunks:   hunks,
+		TreeOID: treeOID,
+	}, nil
+}
+
+// parseUnmergedStages parses the output of `git ls-files -u` (lines of
+// "<mode> <object> <stage>\t<path>") into a per-path map of stage to blob, plus paths in the
+// order they were first seen.
+func parseUnmergedStages(out string) (map[string]map[int]conflictStage, []string, error) {
+	stages := make(map[string]map[int]conflictStage)
+	var paths []string
+
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			return nil, nil, fmt.Errorf("gitserver: unexpected `git ls-files -u` line: %q", line)
+		}
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("gitserver: unexpected `git ls-files -u` line: %q", line)
+		}
+		stage, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, nil, fmt.Errorf("gitserver: unexpected `git ls-files -u` stage: %q", line)
+		}
+
+		path := line[tab+1:]
+		if _, ok := stages[path]; !ok {
+			stages[path] = make(map[int]conflictStage)
+			paths = append(paths, path)
+		}
+		stages[path][stage] = conflictStage{mode: fields[0], object: fields[1]}
+	}
+
+	return stages, paths, nil
+}
+
+// conflictHunk renders the conflict for a path as the diff between its "ours" and "theirs" blobs,
+// which is the actual conflicting content; when only one side touched the path (e.g. added-by-them
+// or deleted-by-us) it falls back to showing that side's content in full.
+func conflictHunk(ctx context.Context, run func(*exec.Cmd) ([]byte, error), dir, gitDirEnv, altObjectsEnv string, byStage map[int]conflictStage) (string, error) {
+	ours, hasOurs := byStage[2]
+	theirs, hasTheirs := byStage[3]
+
+	switch {
+	case hasOurs && hasTheirs:
+		cmd := exec.CommandContext(ctx, "git", "diff", "--no-color", ours.object, theirs.object)
+		cmd.Dir = dir
+		cmd.Env = append(cmd.Env, gitDirEnv, altObjectsEnv)
+
+		out, err := run(cmd)
+		if err != nil {
+			return "", err
+		}
+		return string(out), nil
+
+	case hasOurs:
+		content, err := catFile(ctx, run, dir, gitDirEnv, altObjectsEnv, ours.object)
+		return "deleted by patch; current content:\n" + content, err
+
+	case hasTheirs:
+		content, err := catFile(ctx, run, dir, gitDirEnv, altObjectsEnv, theirs.object)
+		return "added by patch:\n" + content, err
+
+	default:
+		return "", nil
+	}
+}
+
+func catFile(ctx context.Context, run func(*exec.Cmd) ([]byte, error), dir, gitDirEnv, altObjectsEnv, object string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "cat-file", "-p", object)
+	cmd.Dir = dir
+	cmd.Env = append(cmd.Env, gitDirEnv, altObjectsEnv)
+
+	out, err := run(cmd)
+	return string(out), err
+}
+
+// writeResolvedConflictTree resolves every unmerged path to its "ours" blob (falling back to
+// "theirs", then the common ancestor, for paths where "ours" doesn't exist) and writes the
+// resulting tree, since `git write-tree` cannot build a tree over unmerged index entries directly.
+func writeResolvedConflictTree(ctx context.Context, run func(*exec.Cmd) ([]byte, error), dir, gitDirEnv, altObjectsEnv string, stages map[string]map[int]conflictStage, paths []string) (string, error) {
+	for _, p := range paths {
+		byStage := stages[p]
+
+		resolved, ok := byStage[2]
+		if !ok {
+			resolved, ok = byStage[3]
+		}
+		if !ok {
+			resolved, ok = byStage[1]
+		}
+		if !ok {
+			continue
+		}
+
+		cmd := exec.CommandContext(ctx, "git", "update-index", "--cacheinfo", fmt.Sprintf("%s,%s,%s", resolved.mode, resolved.object, p))
+		cmd.Dir = dir
+		cmd.Env = append(cmd.Env, gitDirEnv, altObjectsEnv)
+
+		if _, err := run(cmd); err != nil {
+			return "", err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "write-tree", "--missing-ok")
+	cmd.Dir = dir
+	cmd.Env = append(cmd.Env, gitDirEnv, altObjectsEnv)
+
+	out, err := run(cmd)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// sendPatchConflicts reports unresolved merge conflicts to the caller as a structured response
+// instead of a bare 500, so higher-level code (e.g. campaigns) can retry with a rebased base or
+// surface the conflicted paths to the user.
+func sendPatchConflicts(w http.ResponseWriter, conflicts *protocol.PatchConflicts) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+
+	resp := protocol.CreatePatchFromPatchResponse{Conflicts: conflicts}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("gitserver: failed to encode conflict response: %v", err)
+	}
+}
+
 func cleanUpTmpRepo(path string) {
 	err := os.RemoveAll(path)
 	if err != nil {
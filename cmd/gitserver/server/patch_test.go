@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/pkg/api"
+	"github.com/sourcegraph/sourcegraph/pkg/gitserver/protocol"
+)
+
+// gitTestRepo creates a small git repo under t.TempDir() with user.{name,email} configured, and
+// returns its path.
+func gitTestRepo(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"config", "user.email", "test@sourcegraph.com"},
+		{"config", "user.name", "test"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	return dir
+}
+
+func gitCommitFile(t *testing.T, dir, name, content, message string) string {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"add", name},
+		{"commit", "-q", "-m", message},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func gitRunOutput(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+// testRun adapts exec.Cmd.CombinedOutput to the `run` signature applyPatch/readConflicts expect.
+func testRun(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.CombinedOutput()
+}
+
+// TestApplyPatch_ThreeWayConflict exercises a patch that genuinely conflicts under --3way: "ours"
+// and "theirs" each changed the same line differently from their common ancestor.
+func TestApplyPatch_ThreeWayConflict(t *testing.T) {
+	upstream := gitTestRepo(t)
+	base := gitCommitFile(t, upstream, "file.txt", "line1\nline2\nline3\n", "base")
+	gitCommitFile(t, upstream, "file.txt", "line1\nline2-theirs\nline3\n", "theirs change")
+
+	patch := gitRunOutput(t, upstream, "diff", base, "HEAD", "--", "file.txt")
+	if patch == "" {
+		t.Fatal("expected a non-empty patch")
+	}
+
+	// "ours": a further commit (on top of "theirs"; --3way merges by blob, not by commit ancestry)
+	// that changes the same line differently from base.
+	ours := gitCommitFile(t, upstream, "file.txt", "line1\nline2-ours\nline3\n", "ours change")
+
+	// Mirror handleCreateCommitFromPatch's staging setup: a fresh repo reset to the base revision,
+	// with the upstream repo's objects available via GIT_ALTERNATE_OBJECT_DIRECTORIES.
+	tmpRepoDir := t.TempDir()
+	tmpGitPathEnv := fmt.Sprintf("GIT_DIR=%s/.git", tmpRepoDir)
+	altObjectsEnv := fmt.Sprintf("GIT_ALTERNATE_OBJECT_DIRECTORIES=%s/.git/objects", upstream)
+
+	cmd := exec.Command("git", "init", "-q")
+	cmd.Dir = tmpRepoDir
+	cmd.Env = append(os.Environ(), tmpGitPathEnv)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+
+	cmd = exec.Command("git", "reset", "-q", ours)
+	cmd.Dir = tmpRepoDir
+	cmd.Env = append(os.Environ(), tmpGitPathEnv, altObjectsEnv)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git reset: %v\n%s", err, out)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conflicts, err := applyPatch(ctx, testRun, tmpRepoDir, tmpGitPathEnv, altObjectsEnv, patch, protocol.PatchStrategyThreeWay)
+	if err != nil {
+		t.Fatalf("applyPatch: unexpected error (expected conflicts, not an error): %v", err)
+	}
+	if conflicts == nil {
+		t.Fatal("applyPatch: expected conflicts, got none (patch applied cleanly or failed outright)")
+	}
+
+	if len(conflicts.Paths) != 1 || conflicts.Paths[0] != "file.txt" {
+		t.Fatalf("Paths = %v, want [file.txt]", conflicts.Paths)
+	}
+	if len(conflicts.TreeOID) != 40 {
+		t.Fatalf("TreeOID = %q, want a 40-char object id", conflicts.TreeOID)
+	}
+
+	hunk := conflicts.Hunks["file.txt"]
+	if !strings.Contains(hunk, "line2-ours") || !strings.Contains(hunk, "line2-theirs") {
+		t.Fatalf("Hunks[file.txt] = %q, want a diff between the ours and theirs content", hunk)
+	}
+
+	// The returned TreeOID must be usable: readConflicts resolves conflicted paths to their "ours"
+	// content before writing the tree, so it should come back out unchanged. Here that tree equals the
+	// "ours" commit's tree, which exists only in the upstream object store, so read it through the
+	// same alternates the staging repo uses.
+	cmd = exec.Command("git", "show", conflicts.TreeOID+":file.txt")
+	cmd.Dir = tmpRepoDir
+	cmd.Env = append(os.Environ(), tmpGitPathEnv, altObjectsEnv)
+	treeContent, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git show: %v\n%s", err, treeContent)
+	}
+	if string(treeContent) != "line1\nline2-ours\nline3\n" {
+		t.Fatalf("tree content = %q, want the ours content", treeContent)
+	}
+}
+
+// TestHandleCreateCommitFromPatch_AMMailboxCleanApply exercises the full
+// handleCreateCommitFromPatch handler with PatchStrategyAMMailbox on a patch that applies cleanly.
+// `git am --3way` already commits the patch (with its own message and author) to HEAD, so the
+// handler must not also run its own `git commit` afterwards - doing so fails with "nothing to
+// commit" because the index already matches HEAD.
+func TestHandleCreateCommitFromPatch_AMMailboxCleanApply(t *testing.T) {
+	reposDir := t.TempDir()
+
+	realDir := filepath.Join(reposDir, "myrepo")
+	if err := os.MkdirAll(realDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"config", "user.email", "test@sourcegraph.com"},
+		{"config", "user.name", "test"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = realDir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	base := gitCommitFile(t, realDir, "file.txt", "line1\n", "base")
+
+	// This commit's own message and author are what PatchStrategyAMMailbox promises to preserve -
+	// distinct from both CommitInfo below and the "sourcegraph-committer"/test git config above.
+	if err := os.WriteFile(filepath.Join(realDir, "file.txt"), []byte("line1\nline2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	addCmd := exec.Command("git", "add", "file.txt")
+	addCmd.Dir = realDir
+	if out, err := addCmd.CombinedOutput(); err != nil {
+		t.Fatalf("git add: %v\n%s", err, out)
+	}
+	commitCmd := exec.Command("git", "-c", "user.name=Patch Author", "-c", "user.email=patch-author@example.com", "commit", "-q", "-m", "add line2")
+	commitCmd.Dir = realDir
+	if out, err := commitCmd.CombinedOutput(); err != nil {
+		t.Fatalf("git commit: %v\n%s", err, out)
+	}
+
+	patch := gitRunOutput(t, realDir, "format-patch", "-1", "--stdout", "HEAD")
+
+	req := protocol.CreatePatchFromPatchRequest{
+		Repo:       "myrepo",
+		BaseCommit: api.CommitID(base),
+		TargetRef:  "refs/heads/patched",
+		Patch:      patch,
+		CommitInfo: protocol.PatchCommitInfo{
+			Message:     "request message - must not appear, am already committed with its own",
+			AuthorName:  "Should Not Appear",
+			AuthorEmail: "should-not-appear@example.com",
+		},
+		Strategy: protocol.PatchStrategyAMMailbox,
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{ReposDir: reposDir}
+	rr := httptest.NewRecorder()
+	httpReq := httptest.NewRequest("POST", "/create-commit-from-patch", bytes.NewReader(body))
+	s.handleCreateCommitFromPatch(rr, httpReq)
+
+	if rr.Code != 200 {
+		t.Fatalf("handleCreateCommitFromPatch: status = %d, want 200; body: %s", rr.Code, rr.Body.String())
+	}
+
+	message := gitRunOutput(t, realDir, "log", "-1", "--format=%s", "refs/heads/patched")
+	if strings.TrimSpace(message) != "add line2" {
+		t.Fatalf("commit message = %q, want the patch's own message %q", strings.TrimSpace(message), "add line2")
+	}
+
+	author := gitRunOutput(t, realDir, "log", "-1", "--format=%an <%ae>", "refs/heads/patched")
+	if strings.TrimSpace(author) != "Patch Author <patch-author@example.com>" {
+		t.Fatalf("commit author = %q, want the patch's own author", strings.TrimSpace(author))
+	}
+
+	content := gitRunOutput(t, realDir, "show", "refs/heads/patched:file.txt")
+	if content != "line1\nline2\n" {
+		t.Fatalf("file.txt content = %q, want %q", content, "line1\nline2\n")
+	}
+}
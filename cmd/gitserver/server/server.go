@@ -0,0 +1,14 @@
+package server
+
+// Server serves gitserver's HTTP API and performs git operations directly against the repos stored
+// under ReposDir.
+type Server struct {
+	// ReposDir is the root directory holding gitserver's repos.
+	ReposDir string
+
+	// PostRefUpdate, if set, is invoked synchronously whenever handleCreateCommitFromPatch
+	// successfully moves a ref, after the configured GITSERVER_POSTUPDATE_URL hook (if any) has been
+	// called. It lets tests and in-process callers observe ref updates without needing an external
+	// HTTP endpoint.
+	PostRefUpdate func(repo, ref, oldOID, newOID, pusher string)
+}
@@ -0,0 +1,214 @@
+package repoupdater
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/pkg/repoupdater/protocol"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// gitAskpassHelper is the path to the tiny binary (cmd/gitserver-askpass) that repoupdater installs
+// alongside itself; git invokes it as GIT_ASKPASS, and it reads the credential out of its own
+// environment and writes it to stdout, so tokens never appear on the command line or in command
+// logs.
+var gitAskpassHelper = "/usr/local/bin/gitserver-askpass"
+
+const (
+	pushRetryAttempts  = 5
+	pushRetryBaseDelay = 200 * time.Millisecond
+	pushRetryMaxDelay  = 5 * time.Second
+)
+
+// handlePushRef mirrors a locally created ref (e.g. one created via gitserver's
+// create-commit-from-patch endpoint) to RemoteRef on RemoteURL, layered directly on top of that
+// flow: it runs `git push` from the same on-disk repo gitserver writes to.
+func (s *Server) handlePushRef(w http.ResponseWriter, r *http.Request) {
+	var req protocol.PushRefRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	realDir := path.Join(s.ReposDir, strings.ToLower(string(req.Repo)))
+
+	refspec := req.LocalRef + ":" + req.RemoteRef
+	if req.Force {
+		refspec = "+" + refspec
+	}
+
+	ctx := r.Context()
+
+	credEnv, cleanup, err := s.pushCredentialEnv(ctx, req.Credential)
+	if err != nil {
+		http.Error(w, "repoupdater: resolving push credential - "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer cleanup()
+
+	sha, err := pushWithRetry(ctx, realDir, req.RemoteURL, refspec, credEnv)
+	if err != nil {
+		log15.Error("Failed to push ref to remote.", "repo", req.Repo, "remote", req.RemoteURL, "ref", req.RemoteRef, "error", err)
+		http.Error(w, "repoupdater: pushing ref - "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := protocol.PushRefResponse{RemoteSHA: sha}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("repoupdater: failed to encode push-ref response: %v", err)
+	}
+}
+
+// pushCredentialEnv resolves cred (if any) into extra environment variables for the `git push`
+// subprocess, plus a cleanup func that must always be called once the push is done (it removes any
+// temporary SSH key material written to disk).
+func (s *Server) pushCredentialEnv(ctx context.Context, cred *protocol.PushCredential) (env []string, cleanup func(), err error) {
+	noop := func() {}
+	if cred == nil {
+		return nil, noop, nil
+	}
+
+	switch {
+	case cred.TokenSecret != "":
+		token, err := s.resolveSecret(ctx, cred.TokenSecret)
+		if err != nil {
+			return nil, noop, err
+		}
+		return []string{
+			fmt.Sprintf("GIT_ASKPASS=%s", gitAskpassHelper),
+			"GITSERVER_ASKPASS_USERNAME=x-access-token",
+			fmt.Sprintf("GITSERVER_ASKPASS_TOKEN=%s", token),
+		}, noop, nil
+
+	case cred.SSHKeySecret != "":
+		key, err := s.resolveSecret(ctx, cred.SSHKeySecret)
+		if err != nil {
+			return nil, noop, err
+		}
+
+		keyFile, err := ioutil.TempFile("", "push-ref-ssh-key-")
+		if err != nil {
+			return nil, noop, err
+		}
+		if _, err := keyFile.WriteString(key); err != nil {
+			keyFile.Close()
+			os.Remove(keyFile.Name())
+			return nil, noop, err
+		}
+		keyFile.Close()
+		if err := os.Chmod(keyFile.Name(), 0o600); err != nil {
+			os.Remove(keyFile.Name())
+			return nil, noop, err
+		}
+
+		return []string{
+				fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o StrictHostKeyChecking=no -o IdentitiesOnly=yes", keyFile.Name()),
+			}, func() {
+				os.Remove(keyFile.Name())
+			}, nil
+	}
+
+	return nil, noop, nil
+}
+
+// pushWithRetry runs `git push` from dir, retrying transient network failures with jittered
+// exponential backoff, and returns the SHA remoteRef points to on the remote afterwards.
+func pushWithRetry(ctx context.Context, dir, remoteURL, refspec string, credEnv []string) (string, error) {
+	var lastErr error
+	for attempt := 1; attempt <= pushRetryAttempts; attempt++ {
+		if attempt > 1 {
+			wait := pushRetryBaseDelay << uint(attempt-2)
+			if wait <= 0 || wait > pushRetryMaxDelay {
+				wait = pushRetryMaxDelay
+			}
+			wait = wait/2 + time.Duration(rand.Int63n(int64(wait)/2+1))
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		if err := push(ctx, dir, remoteURL, refspec, credEnv); err != nil {
+			if !isTransientPushError(err) {
+				return "", err
+			}
+			lastErr = err
+			log.Printf("repoupdater: push attempt %d/%d to %s failed, retrying: %v", attempt, pushRetryAttempts, remoteURL, err)
+			continue
+		}
+
+		return remoteRefSHA(ctx, dir, remoteURL, refspec, credEnv)
+	}
+
+	return "", lastErr
+}
+
+func push(ctx context.Context, dir, remoteURL, refspec string, credEnv []string) error {
+	cmd := exec.CommandContext(ctx, "git", "push", remoteURL, refspec)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), credEnv...)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func remoteRefSHA(ctx context.Context, dir, remoteURL, refspec string, credEnv []string) (string, error) {
+	remoteRef := refspec
+	if i := strings.LastIndex(refspec, ":"); i >= 0 {
+		remoteRef = refspec[i+1:]
+	}
+	remoteRef = strings.TrimPrefix(remoteRef, "+")
+
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", remoteURL, remoteRef)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), credEnv...)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("remote ref %s not found on %s after push", remoteRef, remoteURL)
+	}
+	return fields[0], nil
+}
+
+// isTransientPushError reports whether err looks like a network-level failure worth retrying,
+// rather than e.g. a rejected non-fast-forward push or an authentication failure.
+func isTransientPushError(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{
+		"Could not resolve host",
+		"Connection reset by peer",
+		"Connection timed out",
+		"connection timed out",
+		"TLS handshake timeout",
+		"remote end hung up unexpectedly",
+		"unexpected disconnect",
+		"i/o timeout",
+		"EOF",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
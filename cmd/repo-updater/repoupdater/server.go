@@ -0,0 +1,23 @@
+package repoupdater
+
+import "context"
+
+// Server serves repo-updater's HTTP API.
+type Server struct {
+	// ReposDir is the root directory holding gitserver's repos. Server.handlePushRef pushes directly
+	// from a repo's working copy under here.
+	ReposDir string
+
+	// ResolveSecret, if set, resolves a secret reference (PushCredential.TokenSecret or
+	// SSHKeySecret) to its plaintext value. Defaults to treating the reference as the secret itself,
+	// which is only appropriate in tests - production deployments should set this to look the
+	// reference up in the configured secrets store.
+	ResolveSecret func(ctx context.Context, secretRef string) (string, error)
+}
+
+func (s *Server) resolveSecret(ctx context.Context, secretRef string) (string, error) {
+	if s.ResolveSecret != nil {
+		return s.ResolveSecret(ctx, secretRef)
+	}
+	return secretRef, nil
+}
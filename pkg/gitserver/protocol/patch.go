@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/pkg/api"
+)
+
+// NormalizeRepo returns repo in the canonical form gitserver uses to key its repo directories.
+func NormalizeRepo(repo api.RepoName) api.RepoName {
+	return api.RepoName(strings.ToLower(string(repo)))
+}
+
+// PatchCommitInfo holds the author/committer metadata gitserver uses when committing a patch.
+type PatchCommitInfo struct {
+	Message     string
+	AuthorName  string
+	AuthorEmail string
+	Date        time.Time
+}
+
+// PatchStrategy controls how gitserver applies CreatePatchFromPatchRequest.Patch on top of BaseCommit.
+type PatchStrategy string
+
+const (
+	// PatchStrategyStrict applies the patch with `git apply --cached`, failing outright if any hunk
+	// doesn't apply cleanly. This is the historical, default behavior.
+	PatchStrategyStrict PatchStrategy = "strict"
+
+	// PatchStrategyThreeWay applies the patch with `git apply --3way`, which falls back to a
+	// three-way merge (using the blobs the patch was generated against) when a hunk doesn't apply
+	// cleanly, leaving conflicted paths unmerged in the index rather than failing outright.
+	PatchStrategyThreeWay PatchStrategy = "three_way"
+
+	// PatchStrategyAMMailbox applies the patch as a mailbox-formatted commit via `git am --3way`,
+	// preserving the patch's own commit message and author instead of CommitInfo.
+	PatchStrategyAMMailbox PatchStrategy = "am_mailbox"
+)
+
+// CreatePatchFromPatchRequest is the request sent to gitserver's create-commit-from-patch endpoint.
+type CreatePatchFromPatchRequest struct {
+	Repo       api.RepoName
+	BaseCommit api.CommitID
+	TargetRef  string
+	Patch      string
+	CommitInfo PatchCommitInfo
+
+	// Strategy selects how the patch is applied on top of BaseCommit. Defaults to
+	// PatchStrategyStrict when empty.
+	Strategy PatchStrategy
+
+	// Fallback, when Strategy is PatchStrategyThreeWay or PatchStrategyAMMailbox and the three-way
+	// apply still leaves conflicts, tells gitserver to retry once with PatchStrategyStrict instead of
+	// returning a PatchConflicts response.
+	Fallback bool
+}
+
+// PatchConflicts describes the conflicted state left behind by a non-strict patch application that
+// could not be resolved automatically.
+type PatchConflicts struct {
+	// Paths are the repo-relative paths the apply left unmerged.
+	Paths []string
+
+	// Hunks maps each path in Paths to the `git diff` between its "ours" (base) and "theirs" (patch)
+	// blobs; when only one side has the path, it holds that side's full content instead.
+	Hunks map[string]string
+
+	// TreeOID is the tree object written with `git write-tree --missing-ok` after each conflicted
+	// path was resolved to its "ours" side, so it holds the cleanly-applied hunks with the conflicted
+	// paths at their pre-patch content. Its objects are copied into the repo, so callers can inspect
+	// it without gitserver having to retain any tmp directory.
+	TreeOID string
+}
+
+// CreatePatchFromPatchResponse is returned once the patch has been committed and a ref created, or
+// describes the conflicts that prevented that when Strategy was not PatchStrategyStrict.
+type CreatePatchFromPatchResponse struct {
+	Rev string
+
+	// Conflicts is set instead of Rev when a three-way or am-mailbox apply left unresolved conflicts
+	// and CreatePatchFromPatchRequest.Fallback was false.
+	Conflicts *PatchConflicts `json:",omitempty"`
+}
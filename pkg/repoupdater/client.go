@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/opentracing-contrib/go-stdlib/nethttp"
 	opentracing "github.com/opentracing/opentracing-go"
@@ -16,6 +18,7 @@ import (
 	"github.com/sourcegraph/sourcegraph/pkg/env"
 	"github.com/sourcegraph/sourcegraph/pkg/gitserver"
 	"github.com/sourcegraph/sourcegraph/pkg/repoupdater/protocol"
+	"golang.org/x/sync/singleflight"
 )
 
 var repoupdaterURL = env.Get("REPO_UPDATER_URL", "http://repo-updater:3182", "repo-updater server URL")
@@ -54,6 +57,54 @@ type Client struct {
 
 	// HTTP client to use
 	HTTPClient *http.Client
+
+	// RepoLookupCache, if set, caches RepoLookup results with key-level locking to avoid a
+	// thundering herd against repo-updater when many concurrent callers look up the same repo. Nil
+	// disables caching.
+	RepoLookupCache RepoLookupCache
+
+	// RepoLookupCacheLockTTL is how long a RepoLookupCache lock is held before it's considered
+	// abandoned. Defaults to 10s.
+	RepoLookupCacheLockTTL time.Duration
+
+	// RepoLookupCacheWaitTimeout bounds how long RepoLookup waits for another goroutine that holds
+	// the RepoLookupCache lock for the same key to populate the cache, before giving up with
+	// ErrCacheKeyLocked. Defaults to 2s.
+	RepoLookupCacheWaitTimeout time.Duration
+
+	// RetryPolicy controls httpPost's backoff between retries of idempotent methods. Defaults to
+	// DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+
+	// Breaker short-circuits httpPost once c.URL has failed repeatedly. Defaults to a CircuitBreaker
+	// shared by all Clients that don't set their own.
+	Breaker *CircuitBreaker
+
+	// ErrorDecoder turns a non-2xx httpPost response into an error. Defaults to decodeHTTPError.
+	ErrorDecoder ErrorDecoder
+
+	// enqueueRepoUpdateGroup coalesces concurrent EnqueueRepoUpdate calls for the same repo into a
+	// single HTTP request, and enqueueRepoUpdateCache suppresses duplicate requests immediately
+	// after completion. These are scoped per-Client (rather than shared package-level state) so that
+	// Clients pointed at different repo-updater URLs, e.g. in tests, never coalesce or cache across
+	// each other.
+	enqueueRepoUpdateGroup   singleflight.Group
+	enqueueRepoUpdateCacheMu sync.Mutex
+	enqueueRepoUpdateCache   map[string]enqueueRepoUpdateCacheEntry
+}
+
+func (c *Client) repoLookupCacheLockTTL() time.Duration {
+	if c.RepoLookupCacheLockTTL > 0 {
+		return c.RepoLookupCacheLockTTL
+	}
+	return 10 * time.Second
+}
+
+func (c *Client) repoLookupCacheWaitTimeout() time.Duration {
+	if c.RepoLookupCacheWaitTimeout > 0 {
+		return c.RepoLookupCacheWaitTimeout
+	}
+	return 2 * time.Second
 }
 
 // RepoUpdateSchedulerInfo returns information about the state of the repo in the update scheduler.
@@ -62,11 +113,6 @@ func (c *Client) RepoUpdateSchedulerInfo(ctx context.Context, args protocol.Repo
 	if err != nil {
 		return nil, err
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		stack := fmt.Sprintf("RepoScheduleInfo: %+v", args)
-		return nil, errors.Wrap(fmt.Errorf("http status %d", resp.StatusCode), stack)
-	}
 	defer resp.Body.Close()
 	err = json.NewDecoder(resp.Body).Decode(&result)
 	return result, err
@@ -101,17 +147,45 @@ func (c *Client) RepoLookup(ctx context.Context, args protocol.RepoLookupArgs) (
 		span.SetTag("Repo", string(args.Repo))
 	}
 
+	if c.RepoLookupCache == nil {
+		return c.doRepoLookup(ctx, args)
+	}
+
+	key := repoLookupCacheKey(args)
+
+	if cached, ok, cErr := c.RepoLookupCache.Get(ctx, key); cErr == nil && ok {
+		span.SetTag("cached", true)
+		return cached, nil
+	}
+
+	locked, lErr := c.RepoLookupCache.Lock(ctx, key, c.repoLookupCacheLockTTL())
+	if lErr != nil {
+		return c.doRepoLookup(ctx, args)
+	}
+	if !locked {
+		return c.waitForRepoLookupCache(ctx, key)
+	}
+	defer c.RepoLookupCache.Unlock(ctx, key)
+
+	result, err = c.doRepoLookup(ctx, args)
+	// doRepoLookup returns a non-nil err alongside result for ErrorNotFound/ErrorUnauthorized, so we
+	// must check result's fields directly rather than err == nil. Errors other than "temporarily
+	// unavailable" (not found, unauthorized) are still cached: they're as stable as a successful
+	// lookup until the underlying repo/permissions change.
+	if result != nil && !result.ErrorTemporarilyUnavailable {
+		_ = c.RepoLookupCache.Set(ctx, key, result)
+	}
+	return result, err
+}
+
+func (c *Client) doRepoLookup(ctx context.Context, args protocol.RepoLookupArgs) (*protocol.RepoLookupResult, error) {
 	resp, err := c.httpPost(ctx, "repo-lookup", args)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	stack := fmt.Sprintf("RepoLookup: %+v", args)
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Wrap(fmt.Errorf("http status %d", resp.StatusCode), stack)
-	}
-
+	var result *protocol.RepoLookupResult
 	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err == nil && result != nil {
 		switch {
@@ -126,6 +200,36 @@ func (c *Client) RepoLookup(ctx context.Context, args protocol.RepoLookupArgs) (
 	return result, err
 }
 
+// waitForRepoLookupCache polls c.RepoLookupCache for key until another goroutine (which holds the
+// lock for key) populates it, or c.repoLookupCacheWaitTimeout elapses.
+func (c *Client) waitForRepoLookupCache(ctx context.Context, key string) (*protocol.RepoLookupResult, error) {
+	deadline := time.Now().Add(c.repoLookupCacheWaitTimeout())
+	const pollInterval = 50 * time.Millisecond
+
+	for {
+		if result, ok, err := c.RepoLookupCache.Get(ctx, key); err == nil && ok {
+			return result, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrCacheKeyLocked
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// repoLookupCacheKey derives a RepoLookupCache key from args, preferring the external service
+// identity (which is stable across renames) over the repo name.
+func repoLookupCacheKey(args protocol.RepoLookupArgs) string {
+	if args.ExternalRepo != nil {
+		return fmt.Sprintf("external:%s:%s", args.ExternalRepo.ServiceID, args.ExternalRepo.ID)
+	}
+	return fmt.Sprintf("repo:%s", args.Repo)
+}
+
 // Repo represents a repository on gitserver. It contains the information necessary to identify and
 // create/clone it.
 type Repo struct {
@@ -140,13 +244,79 @@ type Repo struct {
 // MockEnqueueRepoUpdate mocks (*Client).EnqueueRepoUpdate for tests.
 var MockEnqueueRepoUpdate func(ctx context.Context, repo gitserver.Repo) (*protocol.RepoUpdateResponse, error)
 
-// EnqueueRepoUpdate requests that the named repository be updated in the near
-// future. It does not wait for the update.
+// enqueueRepoUpdateCacheTTL is how long a completed EnqueueRepoUpdate response is reused to
+// suppress duplicate requests for the same repo.
+var enqueueRepoUpdateCacheTTL = func() time.Duration {
+	d, err := time.ParseDuration(env.Get("REPO_UPDATER_ENQUEUE_CACHE_TTL", "5s", "how long to suppress duplicate EnqueueRepoUpdate requests for the same repo"))
+	if err != nil {
+		return 5 * time.Second
+	}
+	return d
+}()
+
+type enqueueRepoUpdateCacheEntry struct {
+	resp    *protocol.RepoUpdateResponse
+	expires time.Time
+}
+
+func enqueueRepoUpdateCacheKey(repo gitserver.Repo) string {
+	return string(repo.Name) + "\x00" + repo.URL
+}
+
+// EnqueueRepoUpdate requests that the named repository be updated in the near future. It does not
+// wait for the update.
+//
+// Concurrent calls for the same repo are coalesced into a single HTTP request via singleflight, and
+// the response is cached for enqueueRepoUpdateCacheTTL to suppress duplicate requests immediately
+// after completion. This matters because EnqueueRepoUpdate is called from many goroutines (the
+// search indexer, webhook receivers, the UI) that often race to schedule the same repo.
 func (c *Client) EnqueueRepoUpdate(ctx context.Context, repo gitserver.Repo) (*protocol.RepoUpdateResponse, error) {
 	if MockEnqueueRepoUpdate != nil {
 		return MockEnqueueRepoUpdate(ctx, repo)
 	}
 
+	key := enqueueRepoUpdateCacheKey(repo)
+
+	c.enqueueRepoUpdateCacheMu.Lock()
+	entry, ok := c.enqueueRepoUpdateCache[key]
+	c.enqueueRepoUpdateCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.resp, nil
+	}
+
+	v, err, _ := c.enqueueRepoUpdateGroup.Do(key, func() (interface{}, error) {
+		return c.doEnqueueRepoUpdate(ctx, repo)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := v.(*protocol.RepoUpdateResponse)
+
+	c.enqueueRepoUpdateCacheMu.Lock()
+	if c.enqueueRepoUpdateCache == nil {
+		c.enqueueRepoUpdateCache = map[string]enqueueRepoUpdateCacheEntry{}
+	}
+	c.enqueueRepoUpdateCache[key] = enqueueRepoUpdateCacheEntry{resp: resp, expires: time.Now().Add(enqueueRepoUpdateCacheTTL)}
+	evictExpiredEnqueueRepoUpdateCacheEntries(c.enqueueRepoUpdateCache)
+	c.enqueueRepoUpdateCacheMu.Unlock()
+
+	return resp, nil
+}
+
+// evictExpiredEnqueueRepoUpdateCacheEntries sweeps cache for entries that have outlived
+// enqueueRepoUpdateCacheTTL, so that a long-lived Client (e.g. DefaultClient, which is hit by the
+// search indexer, webhook receivers, and the UI for the lifetime of the process) doesn't
+// accumulate one entry per distinct repo ever seen. Called with enqueueRepoUpdateCacheMu held.
+func evictExpiredEnqueueRepoUpdateCacheEntries(cache map[string]enqueueRepoUpdateCacheEntry) {
+	now := time.Now()
+	for key, entry := range cache {
+		if now.After(entry.expires) {
+			delete(cache, key)
+		}
+	}
+}
+
+func (c *Client) doEnqueueRepoUpdate(ctx context.Context, repo gitserver.Repo) (*protocol.RepoUpdateResponse, error) {
 	req := &protocol.RepoUpdateRequest{
 		Repo: repo.Name,
 		URL:  repo.URL,
@@ -164,9 +334,72 @@ func (c *Client) EnqueueRepoUpdate(ctx context.Context, repo gitserver.Repo) (*p
 	}
 
 	var res protocol.RepoUpdateResponse
-	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		return nil, errors.New(string(bs))
-	} else if err = json.Unmarshal(bs, &res); err != nil {
+	if err = json.Unmarshal(bs, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// MockEnqueueRepoUpdates mocks (*Client).EnqueueRepoUpdates for tests.
+var MockEnqueueRepoUpdates func(ctx context.Context, repos []gitserver.Repo) ([]*protocol.RepoUpdateResponse, error)
+
+// EnqueueRepoUpdates behaves like EnqueueRepoUpdate for each of repos, but posts them all in a
+// single HTTP request. This cuts per-request overhead when thousands of repos are scheduled at once,
+// e.g. after a config reload.
+func (c *Client) EnqueueRepoUpdates(ctx context.Context, repos []gitserver.Repo) ([]*protocol.RepoUpdateResponse, error) {
+	if MockEnqueueRepoUpdates != nil {
+		return MockEnqueueRepoUpdates(ctx, repos)
+	}
+
+	reqs := make([]*protocol.RepoUpdateRequest, len(repos))
+	for i, repo := range repos {
+		reqs[i] = &protocol.RepoUpdateRequest{Repo: repo.Name, URL: repo.URL}
+	}
+
+	resp, err := c.httpPost(ctx, "enqueue-repo-updates", reqs)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body")
+	}
+
+	var res []*protocol.RepoUpdateResponse
+	if err = json.Unmarshal(bs, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// MockPushRef mocks (*Client).PushRef for tests.
+var MockPushRef func(ctx context.Context, req protocol.PushRefRequest) (*protocol.PushRefResponse, error)
+
+// PushRef mirrors LocalRef (e.g. one created via gitserver's create-commit-from-patch endpoint) to
+// RemoteRef on RemoteURL, so that patches created on gitserver can be published to a code host
+// without the frontend having to clone the repo itself.
+func (c *Client) PushRef(ctx context.Context, req protocol.PushRefRequest) (*protocol.PushRefResponse, error) {
+	if MockPushRef != nil {
+		return MockPushRef(ctx, req)
+	}
+
+	resp, err := c.httpPost(ctx, "push-ref", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body")
+	}
+
+	var res protocol.PushRefResponse
+	if err = json.Unmarshal(bs, &res); err != nil {
 		return nil, err
 	}
 
@@ -188,11 +421,7 @@ func (c *Client) SyncExternalService(ctx context.Context, svc api.ExternalServic
 	}
 
 	var result protocol.ExternalServiceSyncResult
-	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		// TODO(tsenart): Use response type for unmarshalling errors too.
-		// This needs to be done after rolling out the response type in prod.
-		return nil, errors.New(string(bs))
-	} else if len(bs) == 0 {
+	if len(bs) == 0 {
 		// TODO(keegancsmith): Remove once repo-updater update is rolled out.
 		result.ExternalService = svc
 		return &result, nil
@@ -219,9 +448,7 @@ func (c *Client) RepoExternalServices(ctx context.Context, id uint32) ([]api.Ext
 	}
 
 	var res protocol.RepoExternalServicesResponse
-	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		return nil, errors.New(string(bs))
-	} else if err = json.Unmarshal(bs, &res); err != nil {
+	if err = json.Unmarshal(bs, &res); err != nil {
 		return nil, err
 	}
 
@@ -248,15 +475,44 @@ func (c *Client) ExcludeRepo(ctx context.Context, id uint32) (*protocol.ExcludeR
 	}
 
 	var res protocol.ExcludeRepoResponse
-	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		return nil, errors.New(string(bs))
-	} else if err = json.Unmarshal(bs, &res); err != nil {
+	if err = json.Unmarshal(bs, &res); err != nil {
 		return nil, err
 	}
 
 	return &res, nil
 }
 
+func (c *Client) retryPolicy() RetryPolicy {
+	if c.RetryPolicy.MaxAttempts > 0 {
+		return c.RetryPolicy
+	}
+	return DefaultRetryPolicy
+}
+
+func (c *Client) breaker() *CircuitBreaker {
+	if c.Breaker != nil {
+		return c.Breaker
+	}
+	return defaultBreaker
+}
+
+func (c *Client) errorDecoder() ErrorDecoder {
+	if c.ErrorDecoder != nil {
+		return c.ErrorDecoder
+	}
+	return decodeHTTPError
+}
+
+// defaultBreaker is shared across Clients that don't set their own, so repeated failures against
+// the same repo-updater URL trip the breaker regardless of which Client noticed them first.
+var defaultBreaker = NewCircuitBreaker(5, 30*time.Second)
+
+// httpPost POSTs payload to method as JSON and returns the response. It retries on 5xx responses
+// and network errors according to c.RetryPolicy, but only for methods known to be idempotent
+// (see idempotentMethods) — retrying e.g. enqueue-repo-update could schedule the same update twice.
+// A per-host CircuitBreaker short-circuits with ErrTemporarilyUnavailable once a host has failed
+// repeatedly, and non-2xx responses are translated to an error by c.ErrorDecoder rather than
+// returned as a response for the caller to inspect.
 func (c *Client) httpPost(ctx context.Context, method string, payload interface{}) (resp *http.Response, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "Client.httpPost")
 	defer func() {
@@ -272,6 +528,57 @@ func (c *Client) httpPost(ctx context.Context, method string, payload interface{
 		return nil, err
 	}
 
+	breaker := c.breaker()
+	if !breaker.allow(c.URL) {
+		return nil, ErrTemporarilyUnavailable
+	}
+
+	retryable := idempotentMethods[method]
+	policy := c.retryPolicy()
+	maxAttempts := 1
+	if retryable {
+		maxAttempts = policy.maxAttempts()
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(policy.delay(attempt - 1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		resp, err = c.do(ctx, span, method, reqBody)
+		if err != nil {
+			breaker.recordFailure(c.URL)
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode >= 500 {
+			breaker.recordFailure(c.URL)
+			bs, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			lastErr = c.errorDecoder()(resp.StatusCode, bs)
+			continue
+		}
+
+		breaker.recordSuccess(c.URL)
+		if resp.StatusCode >= 400 {
+			bs, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, c.errorDecoder()(resp.StatusCode, bs)
+		}
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// do issues a single HTTP POST attempt for httpPost.
+func (c *Client) do(ctx context.Context, span opentracing.Span, method string, reqBody []byte) (*http.Response, error) {
 	req, err := http.NewRequest("POST", c.URL+"/"+method, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, err
@@ -0,0 +1,224 @@
+package repoupdater
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/pkg/gitserver"
+	"github.com/sourcegraph/sourcegraph/pkg/repoupdater/protocol"
+)
+
+// enqueueRepoUpdateTestServer is a fake repo-updater backend for EnqueueRepoUpdate tests: it counts
+// POSTs to enqueue-repo-update and optionally blocks until released, so a test can hold the first
+// call in flight while firing concurrent callers at it.
+func enqueueRepoUpdateTestServer(t *testing.T, release <-chan struct{}) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if release != nil {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{})
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &calls
+}
+
+func TestEnqueueRepoUpdate_CoalescesConcurrentCalls(t *testing.T) {
+	release := make(chan struct{})
+	ts, calls := enqueueRepoUpdateTestServer(t, release)
+
+	c := &Client{URL: ts.URL, HTTPClient: ts.Client()}
+	repo := gitserver.Repo{Name: "github.com/foo/bar"}
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := c.EnqueueRepoUpdate(context.Background(), repo)
+			errs[i] = err
+		}(i)
+	}
+
+	// Give every goroutine a chance to reach the singleflight.Do call before unblocking the server,
+	// so they all genuinely race for the same in-flight request rather than running sequentially.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("EnqueueRepoUpdate[%d]: unexpected error: %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Fatalf("server calls = %d, want 1 (concurrent calls for the same repo should coalesce)", got)
+	}
+}
+
+func TestEnqueueRepoUpdate_CachesWithinTTL(t *testing.T) {
+	ts, calls := enqueueRepoUpdateTestServer(t, nil)
+
+	origTTL := enqueueRepoUpdateCacheTTL
+	enqueueRepoUpdateCacheTTL = 50 * time.Millisecond
+	t.Cleanup(func() { enqueueRepoUpdateCacheTTL = origTTL })
+
+	c := &Client{URL: ts.URL, HTTPClient: ts.Client()}
+	repo := gitserver.Repo{Name: "github.com/foo/bar"}
+
+	if _, err := c.EnqueueRepoUpdate(context.Background(), repo); err != nil {
+		t.Fatalf("EnqueueRepoUpdate: %v", err)
+	}
+	if _, err := c.EnqueueRepoUpdate(context.Background(), repo); err != nil {
+		t.Fatalf("EnqueueRepoUpdate: %v", err)
+	}
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Fatalf("server calls = %d, want 1 (second call should be served from cache)", got)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.EnqueueRepoUpdate(context.Background(), repo); err != nil {
+		t.Fatalf("EnqueueRepoUpdate: %v", err)
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Fatalf("server calls = %d, want 2 (cache entry should have expired)", got)
+	}
+}
+
+func TestEnqueueRepoUpdate_EvictsExpiredCacheEntries(t *testing.T) {
+	ts, _ := enqueueRepoUpdateTestServer(t, nil)
+
+	origTTL := enqueueRepoUpdateCacheTTL
+	enqueueRepoUpdateCacheTTL = 10 * time.Millisecond
+	t.Cleanup(func() { enqueueRepoUpdateCacheTTL = origTTL })
+
+	c := &Client{URL: ts.URL, HTTPClient: ts.Client()}
+
+	if _, err := c.EnqueueRepoUpdate(context.Background(), gitserver.Repo{Name: "github.com/foo/bar"}); err != nil {
+		t.Fatalf("EnqueueRepoUpdate: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// A call for a different repo should sweep the now-expired "foo/bar" entry out of the cache,
+	// rather than leaving it (and every other repo ever seen) in the map forever.
+	if _, err := c.EnqueueRepoUpdate(context.Background(), gitserver.Repo{Name: "github.com/baz/qux"}); err != nil {
+		t.Fatalf("EnqueueRepoUpdate: %v", err)
+	}
+
+	c.enqueueRepoUpdateCacheMu.Lock()
+	_, stillCached := c.enqueueRepoUpdateCache[enqueueRepoUpdateCacheKey(gitserver.Repo{Name: "github.com/foo/bar"})]
+	size := len(c.enqueueRepoUpdateCache)
+	c.enqueueRepoUpdateCacheMu.Unlock()
+
+	if stillCached {
+		t.Fatal("expired entry for github.com/foo/bar was not evicted")
+	}
+	if size != 1 {
+		t.Fatalf("cache size = %d, want 1 (only the still-fresh github.com/baz/qux entry)", size)
+	}
+}
+
+// repoLookupTestServer is a fake repo-updater backend for RepoLookup tests: it counts POSTs to
+// repo-lookup and optionally blocks until released, so a test can hold the first call in flight
+// while a second caller races it for the same RepoLookupCache lock.
+func repoLookupTestServer(t *testing.T, result protocol.RepoLookupResult, release <-chan struct{}) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if release != nil {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &calls
+}
+
+func TestRepoLookup_LockOnMissCoalescesRace(t *testing.T) {
+	release := make(chan struct{})
+	ts, calls := repoLookupTestServer(t, protocol.RepoLookupResult{}, release)
+
+	c := &Client{
+		URL:                        ts.URL,
+		HTTPClient:                 ts.Client(),
+		RepoLookupCache:            NewInMemoryRepoLookupCache(),
+		RepoLookupCacheWaitTimeout: time.Second,
+	}
+	args := protocol.RepoLookupArgs{Repo: "github.com/foo/bar"}
+
+	var wg sync.WaitGroup
+	results := make([]*protocol.RepoLookupResult, 2)
+	errs := make([]error, 2)
+
+	// The first caller acquires the lock and blocks in doRepoLookup (via the server); start it first
+	// and give it time to actually take the lock before the second caller races in, so the second
+	// caller genuinely exercises waitForRepoLookupCache rather than also winning the lock.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], errs[0] = c.RepoLookup(context.Background(), args)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[1], errs[1] = c.RepoLookup(context.Background(), args)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("RepoLookup[%d]: unexpected error: %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Fatalf("server calls = %d, want 1 (the second caller should wait for the first's cache entry instead of issuing its own request)", got)
+	}
+	if results[0] != results[1] {
+		t.Fatalf("results = %p, %p, want the second caller to receive the exact cache entry the first caller populated", results[0], results[1])
+	}
+}
+
+func TestRepoLookup_WaitTimeout(t *testing.T) {
+	ts, _ := repoLookupTestServer(t, protocol.RepoLookupResult{}, nil)
+
+	cache := NewInMemoryRepoLookupCache()
+	c := &Client{
+		URL:                        ts.URL,
+		HTTPClient:                 ts.Client(),
+		RepoLookupCache:            cache,
+		RepoLookupCacheWaitTimeout: 30 * time.Millisecond,
+	}
+	args := protocol.RepoLookupArgs{Repo: "github.com/foo/bar"}
+
+	// Simulate another process already holding the lock for this key (e.g. one that crashed before
+	// populating the cache) - the lock TTL outlives this test, so RepoLookup must give up via
+	// c.RepoLookupCacheWaitTimeout rather than hang or busy-loop forever.
+	locked, err := cache.Lock(context.Background(), repoLookupCacheKey(args), time.Minute)
+	if err != nil || !locked {
+		t.Fatalf("Lock: got (%v, %v), want (true, nil)", locked, err)
+	}
+
+	_, err = c.RepoLookup(context.Background(), args)
+	if err != ErrCacheKeyLocked {
+		t.Fatalf("RepoLookup: got error %v, want ErrCacheKeyLocked", err)
+	}
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import "github.com/sourcegraph/sourcegraph/pkg/api"
+
+// PushCredential authenticates a PushRefRequest against the remote code host. At most one field
+// should be set.
+type PushCredential struct {
+	// TokenSecret names a secret in the secrets store holding a plaintext access token (e.g. a
+	// GitHub PAT) to use as the git-askpass password.
+	TokenSecret string
+
+	// SSHKeySecret names a secret in the secrets store holding an SSH private key to push with.
+	SSHKeySecret string
+}
+
+// PushRefRequest is the request sent to repo-updater's /push-ref endpoint to mirror a ref created
+// locally on gitserver (e.g. via gitserver's create-commit-from-patch endpoint) to a remote code
+// host.
+type PushRefRequest struct {
+	Repo api.RepoName
+
+	// LocalRef is the ref on gitserver's copy of Repo to push, e.g. "refs/campaigns/123".
+	LocalRef string
+
+	// RemoteURL is the Git remote URL to push to.
+	RemoteURL string
+
+	// RemoteRef is the ref to update on the remote, e.g. "refs/heads/campaign/123".
+	RemoteRef string
+
+	// Credential authenticates the push. If nil, the push is attempted unauthenticated.
+	Credential *PushCredential
+
+	// Force, if true, pushes with a force-update refspec ("+LocalRef:RemoteRef") rather than a
+	// fast-forward-only one.
+	Force bool
+}
+
+// PushRefResponse is returned once RemoteRef has been updated on the remote.
+type PushRefResponse struct {
+	// RemoteSHA is the SHA RemoteRef points to on the remote after the push succeeded.
+	RemoteSHA string
+}
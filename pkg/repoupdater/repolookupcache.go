@@ -0,0 +1,150 @@
+package repoupdater
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/pkg/redispool"
+	"github.com/sourcegraph/sourcegraph/pkg/repoupdater/protocol"
+)
+
+// ErrCacheKeyLocked is returned by Client.RepoLookup when another caller already holds the
+// RepoLookupCache lock for the looked-up repo and doesn't populate the cache before
+// Client.repoLookupCacheWaitTimeout elapses.
+var ErrCacheKeyLocked = errors.New("repoupdater: repo lookup cache key is locked")
+
+// RepoLookupCache caches protocol.RepoLookupResult values keyed by repository identity, with
+// key-level locking so a cache miss for a popular repo triggers at most one concurrent RepoLookup
+// call to repo-updater rather than a thundering herd. Modeled on argo-cd's revision cache.
+type RepoLookupCache interface {
+	// Get returns the cached result for key, or ok == false on a miss.
+	Get(ctx context.Context, key string) (result *protocol.RepoLookupResult, ok bool, err error)
+
+	// Set caches result for key.
+	Set(ctx context.Context, key string, result *protocol.RepoLookupResult) error
+
+	// Lock attempts to acquire a short-lived lock for key so a single caller populates the cache
+	// while others wait on Get. ok is false if another caller already holds the lock.
+	Lock(ctx context.Context, key string, ttl time.Duration) (ok bool, err error)
+
+	// Unlock releases a lock acquired with Lock.
+	Unlock(ctx context.Context, key string) error
+}
+
+// NewInMemoryRepoLookupCache returns a RepoLookupCache that keeps entries and locks in process
+// memory. It's suitable for a single repo-updater replica or for tests.
+func NewInMemoryRepoLookupCache() RepoLookupCache {
+	return &inMemoryRepoLookupCache{
+		entries: make(map[string]*protocol.RepoLookupResult),
+		locks:   make(map[string]time.Time),
+	}
+}
+
+type inMemoryRepoLookupCache struct {
+	mu      sync.Mutex
+	entries map[string]*protocol.RepoLookupResult
+	locks   map[string]time.Time
+}
+
+func (c *inMemoryRepoLookupCache) Get(ctx context.Context, key string) (*protocol.RepoLookupResult, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, ok := c.entries[key]
+	return result, ok, nil
+}
+
+func (c *inMemoryRepoLookupCache) Set(ctx context.Context, key string, result *protocol.RepoLookupResult) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = result
+	return nil
+}
+
+func (c *inMemoryRepoLookupCache) Lock(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if expires, ok := c.locks[key]; ok && time.Now().Before(expires) {
+		return false, nil
+	}
+	c.locks[key] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (c *inMemoryRepoLookupCache) Unlock(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.locks, key)
+	return nil
+}
+
+const (
+	redisRepoLookupKeyPrefix     = "repo-lookup:"
+	redisRepoLookupLockKeyPrefix = "repo-lookup-lock:"
+)
+
+// NewRedisRepoLookupCache returns a RepoLookupCache backed by the shared Redis pool, so the cache
+// and its locks are shared across all repo-updater replicas. Entries expire after ttl.
+func NewRedisRepoLookupCache(ttl time.Duration) RepoLookupCache {
+	return &redisRepoLookupCache{pool: redispool.Store, ttl: ttl}
+}
+
+type redisRepoLookupCache struct {
+	pool *redis.Pool
+	ttl  time.Duration
+}
+
+func (c *redisRepoLookupCache) Get(ctx context.Context, key string) (*protocol.RepoLookupResult, bool, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	bs, err := redis.Bytes(conn.Do("GET", redisRepoLookupKeyPrefix+key))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	var result protocol.RepoLookupResult
+	if err := json.Unmarshal(bs, &result); err != nil {
+		return nil, false, err
+	}
+	return &result, true, nil
+}
+
+func (c *redisRepoLookupCache) Set(ctx context.Context, key string, result *protocol.RepoLookupResult) error {
+	bs, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("SETEX", redisRepoLookupKeyPrefix+key, int(c.ttl/time.Second), bs)
+	return err
+}
+
+func (c *redisRepoLookupCache) Lock(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.String(conn.Do("SET", redisRepoLookupLockKeyPrefix+key, "1", "NX", "PX", int64(ttl/time.Millisecond)))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+func (c *redisRepoLookupCache) Unlock(ctx context.Context, key string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", redisRepoLookupLockKeyPrefix+key)
+	return err
+}
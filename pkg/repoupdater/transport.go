@@ -0,0 +1,170 @@
+package repoupdater
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// idempotentMethods are the repoupdater endpoints safe for httpPost to retry automatically, because
+// they have no side effect beyond their own result. Endpoints like enqueue-repo-update are
+// deliberately excluded: retrying them could schedule the same update twice.
+var idempotentMethods = map[string]bool{
+	"repo-lookup":                true,
+	"repo-update-scheduler-info": true,
+}
+
+// RetryPolicy configures httpPost's retry-with-backoff behavior for idempotent methods.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first. A value of 1 disables
+	// retries; a value <= 0 means DefaultRetryPolicy is used in place of this policy.
+	MaxAttempts int
+
+	// BaseDelay is the backoff before the second attempt; each subsequent attempt doubles it, up to
+	// MaxDelay. Jitter then picks the actual wait at random between half that delay and all of it.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the (pre-jitter) backoff delay.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used when Client.RetryPolicy is the zero value.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts > 0 {
+		return p.MaxAttempts
+	}
+	return DefaultRetryPolicy.MaxAttempts
+}
+
+// delay returns the backoff before the given attempt (1-indexed: the wait before the 2nd, 3rd, ...
+// attempt).
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = DefaultRetryPolicy.BaseDelay
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = DefaultRetryPolicy.MaxDelay
+	}
+
+	d := base << uint(attempt-1)
+	if d <= 0 || d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// CircuitBreaker trips for a host after FailureThreshold consecutive httpPost failures against it,
+// and then short-circuits further calls to that host with ErrTemporarilyUnavailable until
+// ResetTimeout has passed.
+type CircuitBreaker struct {
+	FailureThreshold int
+	ResetTimeout     time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*breakerState
+}
+
+type breakerState struct {
+	consecutiveFailures int
+	openUntil           time.Time
+}
+
+// NewCircuitBreaker returns a CircuitBreaker that opens after failureThreshold consecutive failures
+// against a host, and stays open for resetTimeout.
+func NewCircuitBreaker(failureThreshold int, resetTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: failureThreshold,
+		ResetTimeout:     resetTimeout,
+		hosts:            make(map[string]*breakerState),
+	}
+}
+
+func (b *CircuitBreaker) threshold() int {
+	if b.FailureThreshold > 0 {
+		return b.FailureThreshold
+	}
+	return 5
+}
+
+func (b *CircuitBreaker) resetTimeout() time.Duration {
+	if b.ResetTimeout > 0 {
+		return b.ResetTimeout
+	}
+	return 30 * time.Second
+}
+
+// allow reports whether a request to host may proceed.
+func (b *CircuitBreaker) allow(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := b.hosts[host]
+	if st == nil || st.consecutiveFailures < b.threshold() {
+		return true
+	}
+	return !time.Now().Before(st.openUntil)
+}
+
+func (b *CircuitBreaker) recordSuccess(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if st := b.hosts[host]; st != nil {
+		st.consecutiveFailures = 0
+	}
+}
+
+func (b *CircuitBreaker) recordFailure(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := b.hosts[host]
+	if st == nil {
+		st = &breakerState{}
+		b.hosts[host] = st
+	}
+	st.consecutiveFailures++
+	if st.consecutiveFailures >= b.threshold() {
+		st.openUntil = time.Now().Add(b.resetTimeout())
+	}
+}
+
+// ErrorDecoder turns a non-2xx HTTP response body into an error.
+type ErrorDecoder func(statusCode int, body []byte) error
+
+// HTTPError is the error produced by the default ErrorDecoder. It carries the structured
+// {"code", "message"} error body repoupdater sends on non-2xx responses, falling back to the raw
+// body as Message when the response isn't in that shape (e.g. an upstream proxy error page).
+type HTTPError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *HTTPError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("repoupdater: %s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("repoupdater: http status %d: %s", e.StatusCode, e.Message)
+}
+
+// decodeHTTPError is the default ErrorDecoder.
+func decodeHTTPError(statusCode int, body []byte) error {
+	var parsed struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil && (parsed.Code != "" || parsed.Message != "") {
+		return &HTTPError{StatusCode: statusCode, Code: parsed.Code, Message: parsed.Message}
+	}
+	return &HTTPError{StatusCode: statusCode, Message: string(body)}
+}
@@ -0,0 +1,86 @@
+package repoupdater
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(3, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if !b.allow("host") {
+			t.Fatalf("allow: want true before threshold, attempt %d", i)
+		}
+		b.recordFailure("host")
+	}
+	if !b.allow("host") {
+		t.Fatal("allow: want true, threshold not yet reached")
+	}
+
+	b.recordFailure("host")
+	if b.allow("host") {
+		t.Fatal("allow: want false once threshold reached")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow("host") {
+		t.Fatal("allow: want true after ResetTimeout elapses")
+	}
+
+	b.recordSuccess("host")
+	b.recordFailure("host")
+	if !b.allow("host") {
+		t.Fatal("allow: want true, recordSuccess should reset the consecutive failure count")
+	}
+}
+
+func TestCircuitBreaker_PerHost(t *testing.T) {
+	b := NewCircuitBreaker(1, time.Minute)
+
+	b.recordFailure("host-a")
+	if b.allow("host-a") {
+		t.Fatal("allow(host-a): want false after a failure")
+	}
+	if !b.allow("host-b") {
+		t.Fatal("allow(host-b): want true, failures on host-a must not affect host-b")
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 400 * time.Millisecond}
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		d := p.delay(attempt)
+		if d <= 0 || d > p.MaxDelay {
+			t.Fatalf("delay(%d) = %v, want in (0, %v]", attempt, d, p.MaxDelay)
+		}
+	}
+}
+
+func TestRetryPolicy_MaxAttemptsDefault(t *testing.T) {
+	var p RetryPolicy
+	if got := p.maxAttempts(); got != DefaultRetryPolicy.MaxAttempts {
+		t.Fatalf("maxAttempts() = %d, want %d", got, DefaultRetryPolicy.MaxAttempts)
+	}
+}
+
+func TestDecodeHTTPError(t *testing.T) {
+	err := decodeHTTPError(400, []byte(`{"code":"repo_not_found","message":"no such repo"}`))
+	httpErr, ok := err.(*HTTPError)
+	if !ok {
+		t.Fatalf("decodeHTTPError: got %T, want *HTTPError", err)
+	}
+	if httpErr.Code != "repo_not_found" || httpErr.Message != "no such repo" {
+		t.Fatalf("decodeHTTPError: got %+v, want code=repo_not_found message=%q", httpErr, "no such repo")
+	}
+
+	err = decodeHTTPError(502, []byte("bad gateway"))
+	httpErr, ok = err.(*HTTPError)
+	if !ok {
+		t.Fatalf("decodeHTTPError: got %T, want *HTTPError", err)
+	}
+	if httpErr.Code != "" || httpErr.Message != "bad gateway" {
+		t.Fatalf("decodeHTTPError: got %+v, want falling back to the raw body as Message", httpErr)
+	}
+}